@@ -24,6 +24,8 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
@@ -44,6 +46,12 @@ import (
 
 const commitChunkSize = 500
 
+// maxConcurrentGRPCWrites bounds the number of RemoteWrite batches
+// appending to the TSDB at once, across every gRPC stream; batches beyond
+// this are rejected with reasonThrottled rather than piling up against a
+// single appender, mirroring maxConcurrentHTTPWrites on the HTTP path.
+const maxConcurrentGRPCWrites = 8
+
 var (
 	remoteWriteAppendFailure = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -62,28 +70,56 @@ type API struct {
 	enableAdmin bool
 	db          func() *tsdb.DB
 	logger      log.Logger
+	admin       pb.AdminServer
 }
 
-// New returns a new API object.
+// New returns a new API object. relabelConfigPath, if non-empty, points at a
+// YAML file of relabel rules applied to every series ingested through
+// RemoteWrite; it is reloaded on SIGHUP. enableDestructiveAdmin must be set,
+// in addition to enableAdmin, to expose DeleteSeries and
+// TSDBCleanTombstones; snapshotting and remote-write stay available
+// without it. validation bounds what DeleteSeries and RemoteWrite accept;
+// any zero field is replaced by DefaultValidationConfig's.
 func New(
 	db func() *tsdb.DB,
 	enableAdmin bool,
 	logger log.Logger,
+	relabelConfigPath string,
+	enableDestructiveAdmin bool,
+	validation ValidationConfig,
 ) *API {
-	return &API{
+	api := &API{
 		db:          db,
 		enableAdmin: enableAdmin,
 		logger:      logger,
 	}
+	validation = validation.withDefaults()
+	if enableAdmin {
+		api.admin = NewAdmin(db, logger, relabelConfigPath, enableDestructiveAdmin, validation)
+	} else {
+		api.admin = &AdminDisabled{}
+	}
+	return api
 }
 
 // RegisterGRPC registers all API services with the given server.
 func (api *API) RegisterGRPC(srv *grpc.Server) {
-	if api.enableAdmin {
-		pb.RegisterAdminServer(srv, NewAdmin(api.db, api.logger))
-	} else {
-		pb.RegisterAdminServer(srv, &AdminDisabled{})
+	pb.RegisterAdminServer(srv, api.admin)
+}
+
+// RegisterHTTP registers the HTTP remote-write ingestion endpoint on mux. It
+// accepts a snappy-compressed, protobuf-encoded prompb.WriteRequest just like
+// stock Prometheus' remote_write receiver, so tools that already speak that
+// protocol can push into this fork without a gRPC client. It is a no-op when
+// the admin API is disabled. TSDBSnapshot and TSDBSnapshotStatus are
+// reachable over HTTP the same way every other Admin RPC is: through the
+// grpc-gateway mux returned by HTTPHandler.
+func (api *API) RegisterHTTP(mux *http.ServeMux) {
+	admin, ok := api.admin.(*Admin)
+	if !ok {
+		return
 	}
+	mux.HandleFunc(remoteWriteHTTPPath, admin.serveRemoteWriteHTTP)
 }
 
 // HTTPHandler returns an HTTP handler for a REST API gateway to the given grpc address.
@@ -132,8 +168,9 @@ var (
 )
 
 var (
-	errAdminDisabled = status.Error(codes.Unavailable, "Admin APIs are disabled")
-	errTSDBNotReady  = status.Error(codes.Unavailable, "TSDB not ready")
+	errAdminDisabled            = status.Error(codes.Unavailable, "Admin APIs are disabled")
+	errTSDBNotReady             = status.Error(codes.Unavailable, "TSDB not ready")
+	errDestructiveAdminDisabled = status.Error(codes.PermissionDenied, "destructive Admin APIs are disabled; set enableDestructiveAdmin")
 )
 
 // AdminDisabled implements the administration interface that informs
@@ -146,6 +183,11 @@ func (s *AdminDisabled) TSDBSnapshot(_ old_ctx.Context, _ *pb.TSDBSnapshotReques
 	return nil, errAdminDisabled
 }
 
+// TSDBSnapshotStatus implements pb.AdminServer.
+func (s *AdminDisabled) TSDBSnapshotStatus(_ old_ctx.Context, _ *pb.TSDBSnapshotStatusRequest) (*pb.TSDBSnapshotStatusResponse, error) {
+	return nil, errAdminDisabled
+}
+
 // TSDBCleanTombstones implements pb.AdminServer.
 func (s *AdminDisabled) TSDBCleanTombstones(_ old_ctx.Context, _ *pb.TSDBCleanTombstonesRequest) (*pb.TSDBCleanTombstonesResponse, error) {
 	return nil, errAdminDisabled
@@ -163,40 +205,124 @@ func (s *AdminDisabled) RemoteWrite(stream pb.Admin_RemoteWriteServer) error { r
 type Admin struct {
 	db     func() *tsdb.DB
 	logger log.Logger
+
+	// httpWriteSem bounds the number of concurrent HTTP remote-write
+	// requests appending to the TSDB; see serveRemoteWriteHTTP.
+	httpWriteSem chan struct{}
+
+	// grpcWriteSem bounds the number of concurrent RemoteWrite batches
+	// appending to the TSDB; see RemoteWrite.
+	grpcWriteSem chan struct{}
+
+	// refCache caches series refs across batches, requests and appenders
+	// so that only the first sample of a series has to pay for label
+	// resolution, until its entry is evicted or its ref goes stale; see
+	// WriteTimeSeries.
+	refCache *seriesRefCache
+
+	// relabelRules holds the current []*relabel.Config applied to every
+	// ingested series; see remote_write_relabel.go.
+	relabelRules atomic.Value
+
+	// snapshots tracks in-flight and completed snapshot uploads by
+	// snapshot_id; see snapshot_shipper.go.
+	snapshots sync.Map
+
+	// snapshotUploadSem bounds the number of snapshots being shipped to
+	// a remote backend concurrently.
+	snapshotUploadSem chan struct{}
+
+	// enableDestructiveAdmin gates DeleteSeries and TSDBCleanTombstones,
+	// independently of enableAdmin.
+	enableDestructiveAdmin bool
+
+	// validation bounds what DeleteSeries and RemoteWrite accept; see
+	// validation.go.
+	validation ValidationConfig
 }
 
-// NewAdmin returns a Admin server.
-func NewAdmin(db func() *tsdb.DB, logger log.Logger) *Admin {
-	return &Admin{
-		db:     db,
-		logger: logger,
+// NewAdmin returns a Admin server. relabelConfigPath, if non-empty, is
+// loaded as the ingest relabel pipeline and reloaded on SIGHUP.
+// enableDestructiveAdmin gates DeleteSeries and TSDBCleanTombstones. Any
+// zero field of validation is replaced by DefaultValidationConfig's.
+func NewAdmin(db func() *tsdb.DB, logger log.Logger, relabelConfigPath string, enableDestructiveAdmin bool, validation ValidationConfig) *Admin {
+	validation = validation.withDefaults()
+	s := &Admin{
+		db:                     db,
+		logger:                 logger,
+		httpWriteSem:           make(chan struct{}, maxConcurrentHTTPWrites),
+		grpcWriteSem:           make(chan struct{}, maxConcurrentGRPCWrites),
+		refCache:               newSeriesRefCache(defaultSeriesRefCacheSize),
+		snapshotUploadSem:      make(chan struct{}, snapshotUploadWorkers),
+		enableDestructiveAdmin: enableDestructiveAdmin,
+		validation:             validation,
 	}
+	s.watchRelabelConfig(relabelConfigPath)
+	return s
 }
 
-// TSDBSnapshot implements pb.AdminServer.
+// TSDBSnapshot implements pb.AdminServer. If req.Destination is set, the
+// snapshot is additionally shipped to that backend in the background;
+// clients can poll its progress with TSDBSnapshotStatus(name).
 func (s *Admin) TSDBSnapshot(_ old_ctx.Context, req *pb.TSDBSnapshotRequest) (*pb.TSDBSnapshotResponse, error) {
+	name, dir, err := s.createSnapshot(!req.SkipHead)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Destination != "" {
+		job := &snapshotJob{id: name, dir: dir, state: snapshotPending}
+		s.snapshots.Store(job.id, job)
+		go s.shipSnapshot(job, req.Destination, req.CredentialsRef, req.DeleteLocalAfterUpload)
+	}
+
+	return &pb.TSDBSnapshotResponse{Name: name}, nil
+}
+
+// TSDBSnapshotStatus implements pb.AdminServer, reporting the upload state
+// of a snapshot previously created with a Destination via TSDBSnapshot.
+func (s *Admin) TSDBSnapshotStatus(_ old_ctx.Context, req *pb.TSDBSnapshotStatusRequest) (*pb.TSDBSnapshotStatusResponse, error) {
+	v, ok := s.snapshots.Load(req.SnapshotId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown snapshot_id %q", req.SnapshotId)
+	}
+	state, bytesShipped, errMsg := v.(*snapshotJob).status()
+	return &pb.TSDBSnapshotStatusResponse{
+		State:            string(state),
+		BytesTransferred: bytesShipped,
+		Error:            errMsg,
+	}, nil
+}
+
+// createSnapshot writes a TSDB snapshot to a freshly named directory under
+// db.Dir()/snapshots and returns its name and full path. withHead mirrors
+// the inverse of pb.TSDBSnapshotRequest.SkipHead.
+func (s *Admin) createSnapshot(withHead bool) (name, dir string, err error) {
 	db := s.db()
 	if db == nil {
-		return nil, errTSDBNotReady
+		return "", "", errTSDBNotReady
 	}
-	var (
-		snapdir = filepath.Join(db.Dir(), "snapshots")
-		name    = fmt.Sprintf("%s-%x",
-			time.Now().UTC().Format("20060102T150405Z0700"),
-			rand.Int())
-		dir = filepath.Join(snapdir, name)
-	)
+	snapdir := filepath.Join(db.Dir(), "snapshots")
+	name = fmt.Sprintf("%s-%x",
+		time.Now().UTC().Format("20060102T150405Z0700"),
+		rand.Int())
+	dir = filepath.Join(snapdir, name)
+
 	if err := os.MkdirAll(dir, 0777); err != nil {
-		return nil, status.Errorf(codes.Internal, "created snapshot directory: %s", err)
+		return "", "", status.Errorf(codes.Internal, "created snapshot directory: %s", err)
 	}
-	if err := db.Snapshot(dir, !req.SkipHead); err != nil {
-		return nil, status.Errorf(codes.Internal, "create snapshot: %s", err)
+	if err := db.Snapshot(dir, withHead); err != nil {
+		return "", "", status.Errorf(codes.Internal, "create snapshot: %s", err)
 	}
-	return &pb.TSDBSnapshotResponse{Name: name}, nil
+	return name, dir, nil
 }
 
 // TSDBCleanTombstones implements pb.AdminServer.
 func (s *Admin) TSDBCleanTombstones(_ old_ctx.Context, _ *pb.TSDBCleanTombstonesRequest) (*pb.TSDBCleanTombstonesResponse, error) {
+	if !s.enableDestructiveAdmin {
+		return nil, errDestructiveAdminDisabled
+	}
+
 	db := s.db()
 	if db == nil {
 		return nil, errTSDBNotReady
@@ -211,16 +337,33 @@ func (s *Admin) TSDBCleanTombstones(_ old_ctx.Context, _ *pb.TSDBCleanTombstones
 
 // DeleteSeries implements pb.AdminServer.
 func (s *Admin) DeleteSeries(_ old_ctx.Context, r *pb.SeriesDeleteRequest) (*pb.SeriesDeleteResponse, error) {
+	if !s.enableDestructiveAdmin {
+		return nil, errDestructiveAdminDisabled
+	}
+
+	if len(r.Matchers) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one matcher is required")
+	}
+
 	mint, maxt, err := extractTimeRange(r.MinTime, r.MaxTime)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	var matchers tsdbLabels.Selector
+	var (
+		matchers       tsdbLabels.Selector
+		validationErrs []*pb.ValidationError
+	)
 
 	for _, m := range r.Matchers {
 		var lm tsdbLabels.Matcher
 		var err error
 
+		if m.Name == "" {
+			validationErrs = append(validationErrs, &pb.ValidationError{Field: "matcher_name", Message: "matcher name must not be empty"})
+			continue
+		}
+		validationErrs = s.validation.validateLabel(m.Name, m.Value, validationErrs)
+
 		switch m.Type {
 		case pb.LabelMatcher_EQ:
 			lm = tsdbLabels.NewEqualMatcher(m.Name, m.Value)
@@ -229,20 +372,27 @@ func (s *Admin) DeleteSeries(_ old_ctx.Context, r *pb.SeriesDeleteRequest) (*pb.
 		case pb.LabelMatcher_RE:
 			lm, err = tsdbLabels.NewRegexpMatcher(m.Name, m.Value)
 			if err != nil {
-				return nil, status.Errorf(codes.InvalidArgument, "bad regexp matcher: %s", err)
+				validationErrs = append(validationErrs, &pb.ValidationError{Field: "matcher_value", Value: m.Value, Message: err.Error()})
+				continue
 			}
 		case pb.LabelMatcher_NRE:
 			lm, err = tsdbLabels.NewRegexpMatcher(m.Name, m.Value)
 			if err != nil {
-				return nil, status.Errorf(codes.InvalidArgument, "bad regexp matcher: %s", err)
+				validationErrs = append(validationErrs, &pb.ValidationError{Field: "matcher_value", Value: m.Value, Message: err.Error()})
+				continue
 			}
 			lm = tsdbLabels.Not(lm)
 		default:
-			return nil, status.Error(codes.InvalidArgument, "unknown matcher type")
+			validationErrs = append(validationErrs, &pb.ValidationError{Field: "matcher_type", Message: "unknown matcher type"})
+			continue
 		}
 
 		matchers = append(matchers, lm)
 	}
+	if len(validationErrs) > 0 {
+		return nil, validationError("invalid matchers", validationErrs)
+	}
+
 	db := s.db()
 	if db == nil {
 		return nil, errTSDBNotReady
@@ -265,14 +415,44 @@ func (s *Admin) RemoteWrite(stream pb.Admin_RemoteWriteServer) error {
 			return err
 		}
 
-		// Write all metrics sent
-		WriteTimeSeries(resp.GetTimeseries(), s.db, s.logger)
+		// Write all metrics sent and tell the client what happened to
+		// each sample so it can retry intelligently. A batch that would
+		// exceed maxConcurrentGRPCWrites is rejected outright rather
+		// than queuing against a single appender.
+		var writeResp *pb.WriteResponse
+		select {
+		case s.grpcWriteSem <- struct{}{}:
+			writeResp = WriteTimeSeries(resp.GetTimeseries(), s.db, s.logger, s.refCache, s.relabelLabels, s.validation)
+			<-s.grpcWriteSem
+		default:
+			writeResp = throttledResponse(resp.GetTimeseries())
+		}
+		if err := stream.Send(writeResp); err != nil {
+			level.Error(s.logger).Log("msg", "write to grpc stream failure", "err", err)
+			return err
+		}
 	}
 	return nil
 }
 
-// WriteTimeSeries writes a set of timeseries metrics to the tsdb
-func WriteTimeSeries(timeseries []pb.TimeSeries, tsdb func() *tsdb.DB, logger log.Logger) {
+// WriteTimeSeries writes a set of timeseries metrics to the tsdb and reports
+// back how many samples were accepted or rejected, and why, both in
+// aggregate and per series via resp.PerSeries, so a client can retry only
+// the series that actually failed instead of the whole batch. cache caches
+// series refs across calls so that repeat samples for the same series, even
+// across separate calls, can use the AddFast path; pass a fresh cache (or
+// nil) if no such sharing is desired. relabel, if non-nil, is run on every
+// series' labels before appending; a false return drops the series
+// entirely. validation bounds what labels and timestamps are accepted; any
+// zero field is replaced by DefaultValidationConfig's.
+func WriteTimeSeries(timeseries []pb.TimeSeries, tsdb func() *tsdb.DB, logger log.Logger, cache *seriesRefCache, relabel func(tsdbLabels.Labels) (tsdbLabels.Labels, bool), validation ValidationConfig) *pb.WriteResponse {
+	if cache == nil {
+		cache = newSeriesRefCache(defaultSeriesRefCacheSize)
+	}
+	validation = validation.withDefaults()
+
+	resp := &pb.WriteResponse{RejectedByReason: map[string]uint64{}}
+
 	ap := tsdb().Appender()
 
 	commit := func() {
@@ -282,12 +462,18 @@ func WriteTimeSeries(timeseries []pb.TimeSeries, tsdb func() *tsdb.DB, logger lo
 				level.Error(logger).Log("msg", "failure trying to rollback write to store", "err", err)
 			}
 		}
+		// TSDB head refs, unlike the appender that resolved them, are
+		// stable across commits (this is how the scrape loop reuses
+		// them via AddFast from one scrape to the next), so the cache
+		// is deliberately not invalidated here: a stale ref just falls
+		// back to Add via the ErrNotFound check below.
 	}
 	defer commit()
 
 	for i, ts := range timeseries {
 		if i%commitChunkSize == 0 {
 			commit()
+			ap = tsdb().Appender()
 		}
 		lbls := make(tsdbLabels.Labels, len(ts.Labels))
 		for i, l := range ts.Labels {
@@ -299,17 +485,93 @@ func WriteTimeSeries(timeseries []pb.TimeSeries, tsdb func() *tsdb.DB, logger lo
 		// soring guarantees hash consistency
 		sort.Sort(lbls)
 
-		var ref uint64
-		var err error
+		if relabel != nil {
+			var keep bool
+			lbls, keep = relabel(lbls)
+			if !keep {
+				n := uint64(len(ts.Samples))
+				remoteWriteDroppedSamples.WithLabelValues(reasonRelabelDrop).Add(float64(n))
+				resp.Rejected += n
+				resp.RejectedByReason[reasonRelabelDrop] += n
+				resp.PerSeries = append(resp.PerSeries, &pb.SeriesResult{
+					SeriesIndex:      int64(i),
+					Rejected:         n,
+					RejectedByReason: map[string]uint64{reasonRelabelDrop: n},
+				})
+				continue
+			}
+		}
+
+		if !validation.validateSeriesLabels(lbls) {
+			n := uint64(len(ts.Samples))
+			remoteWriteAppendFailure.WithLabelValues(reasonLabelsInvalid).Add(float64(n))
+			resp.Rejected += n
+			resp.RejectedByReason[reasonLabelsInvalid] += n
+			resp.PerSeries = append(resp.PerSeries, &pb.SeriesResult{
+				SeriesIndex:      int64(i),
+				Rejected:         n,
+				RejectedByReason: map[string]uint64{reasonLabelsInvalid: n},
+			})
+			continue
+		}
+
+		hash := lbls.Hash()
+		ref, cached := cache.get(hash, lbls)
+
+		var seriesAccepted, seriesRejected uint64
+		var seriesRejectedByReason map[string]uint64
+		reject := func(reason string) {
+			seriesRejected++
+			if seriesRejectedByReason == nil {
+				seriesRejectedByReason = map[string]uint64{}
+			}
+			seriesRejectedByReason[reason]++
+		}
+
 		for _, s := range ts.Samples {
-			if ref == 0 {
-				ref, err = ap.Add(lbls, s.GetTimestamp(), s.GetValue())
-			} else {
+			if !validation.validateSampleTimestamp(s.GetTimestamp()) {
+				remoteWriteAppendFailure.WithLabelValues(reasonOutOfBounds).Inc()
+				resp.Rejected++
+				resp.RejectedByReason[reasonOutOfBounds]++
+				reject(reasonOutOfBounds)
+				continue
+			}
+
+			var err error
+			if cached {
 				err = ap.AddFast(ref, s.GetTimestamp(), s.GetValue())
+				if err == tsdb.ErrNotFound {
+					cached = false
+					cache.forget(hash)
+				}
+			}
+			if !cached {
+				ref, err = ap.Add(lbls, s.GetTimestamp(), s.GetValue())
+				if err == nil {
+					cache.put(hash, lbls, ref)
+					cached = true
+				}
 			}
 			if err != nil {
-				remoteWriteAppendFailure.WithLabelValues(err.Error()).Inc()
+				reason := remoteWriteRejectReason(err)
+				remoteWriteAppendFailure.WithLabelValues(reason).Inc()
+				resp.Rejected++
+				resp.RejectedByReason[reason]++
+				reject(reason)
+			} else {
+				resp.Accepted++
+				seriesAccepted++
 			}
 		}
+
+		if seriesRejected > 0 {
+			resp.PerSeries = append(resp.PerSeries, &pb.SeriesResult{
+				SeriesIndex:      int64(i),
+				Accepted:         seriesAccepted,
+				Rejected:         seriesRejected,
+				RejectedByReason: seriesRejectedByReason,
+			})
+		}
 	}
+	return resp
 }
@@ -0,0 +1,143 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api_v2
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	pb "github.com/prometheus/prometheus/v3/prompb"
+)
+
+const (
+	// remoteWriteHTTPPath is where the HTTP remote-write receiver is
+	// mounted. It mirrors the path stock Prometheus uses for its own
+	// remote_write receiver, scoped under the admin API.
+	remoteWriteHTTPPath = "/api/v2/admin/tsdb/remote_write"
+
+	// maxWriteRequestSize bounds the compressed request body we are
+	// willing to buffer in memory before snappy-decoding it.
+	maxWriteRequestSize = 64 * 1024 * 1024
+
+	// maxConcurrentHTTPWrites bounds the number of HTTP remote-write
+	// requests appending to the TSDB at once; callers beyond this are
+	// told to back off rather than piling up against a single appender.
+	maxConcurrentHTTPWrites = 8
+)
+
+var (
+	remoteWriteHTTPRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "prometheus_remote_write_http_requests_total",
+			Help: "Total number of HTTP remote-write requests by response code.",
+		}, []string{"code"},
+	)
+	remoteWriteHTTPBatchSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "prometheus_remote_write_http_batch_size",
+			Help:    "Number of timeseries decoded from an HTTP remote-write request.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(remoteWriteHTTPRequests, remoteWriteHTTPBatchSize)
+}
+
+// serveRemoteWriteHTTP implements the stock Prometheus remote_write wire
+// protocol: a POST of a snappy-compressed, protobuf-encoded
+// prompb.WriteRequest, identified by the usual Content-Encoding,
+// Content-Type and X-Prometheus-Remote-Write-Version headers. Decoded
+// series are fed into the same WriteTimeSeries path used by the gRPC
+// Admin.RemoteWrite service.
+func (s *Admin) serveRemoteWriteHTTP(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusNoContent
+	defer func() { remoteWriteHTTPRequests.WithLabelValues(strconv.Itoa(code)).Inc() }()
+
+	if r.Method != http.MethodPost {
+		code = http.StatusMethodNotAllowed
+		http.Error(w, "only POST is supported", code)
+		return
+	}
+
+	db := s.db()
+	if db == nil {
+		code = http.StatusServiceUnavailable
+		http.Error(w, errTSDBNotReady.Error(), code)
+		return
+	}
+
+	if enc := r.Header.Get("Content-Encoding"); enc != "snappy" {
+		code = http.StatusUnsupportedMediaType
+		http.Error(w, fmt.Sprintf("unsupported Content-Encoding %q, expected snappy", enc), code)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+		code = http.StatusUnsupportedMediaType
+		http.Error(w, fmt.Sprintf("unsupported Content-Type %q, expected application/x-protobuf", ct), code)
+		return
+	}
+	if v := r.Header.Get("X-Prometheus-Remote-Write-Version"); v == "" {
+		code = http.StatusBadRequest
+		http.Error(w, "missing X-Prometheus-Remote-Write-Version header", code)
+		return
+	}
+
+	select {
+	case s.httpWriteSem <- struct{}{}:
+		defer func() { <-s.httpWriteSem }()
+	default:
+		code = http.StatusTooManyRequests
+		http.Error(w, "too many concurrent remote-write requests", code)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWriteRequestSize))
+	if err != nil {
+		code = http.StatusBadRequest
+		http.Error(w, fmt.Sprintf("read request body: %s", err), code)
+		return
+	}
+
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		code = http.StatusBadRequest
+		http.Error(w, fmt.Sprintf("snappy decode: %s", err), code)
+		return
+	}
+
+	var req pb.WriteRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		code = http.StatusBadRequest
+		http.Error(w, fmt.Sprintf("unmarshal WriteRequest: %s", err), code)
+		return
+	}
+
+	remoteWriteHTTPBatchSize.Observe(float64(len(req.Timeseries)))
+	level.Debug(s.logger).Log("msg", "ingested HTTP remote-write request", "series", len(req.Timeseries))
+
+	// HTTP clients speaking the stock remote_write protocol don't expect
+	// a body back, so we only surface per-sample accept/reject detail to
+	// gRPC Admin.RemoteWrite streams; here it's enough to fold rejections
+	// into the shared remoteWriteAppendFailure metric.
+	WriteTimeSeries(req.Timeseries, s.db, s.logger, s.refCache, s.relabelLabels, s.validation)
+	w.WriteHeader(code)
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api_v2
+
+import (
+	"github.com/prometheus/tsdb"
+
+	pb "github.com/prometheus/prometheus/v3/prompb"
+)
+
+// Reject reasons reported back to RemoteWrite clients and used as the
+// "reason" label on remoteWriteAppendFailure (reasonRelabelDrop labels
+// remoteWriteDroppedSamples instead). This is a fixed, small set so
+// the metric stays bounded-cardinality; never stringify an arbitrary error
+// into it.
+const (
+	reasonOutOfOrder      = "out_of_order_sample"
+	reasonOutOfBounds     = "out_of_bounds"
+	reasonDuplicateSample = "duplicate_sample"
+	reasonLabelsInvalid   = "labels_invalid"
+	reasonThrottled       = "throttled"
+	reasonRelabelDrop     = "relabel_drop"
+	reasonOther           = "other"
+)
+
+// remoteWriteRejectReason maps a tsdb append error to one of the fixed
+// reject reasons above.
+func remoteWriteRejectReason(err error) string {
+	switch err {
+	case tsdb.ErrOutOfOrderSample:
+		return reasonOutOfOrder
+	case tsdb.ErrOutOfBounds:
+		return reasonOutOfBounds
+	case tsdb.ErrAmendSample:
+		return reasonDuplicateSample
+	default:
+		return reasonOther
+	}
+}
+
+// throttledResponse rejects every sample in series with reasonThrottled,
+// for a batch turned away by RemoteWrite's concurrency limit before it
+// ever reaches WriteTimeSeries. Every series gets its own PerSeries entry,
+// same as a WriteTimeSeries rejection, so a client can tell throttling
+// apart from a validation or append failure per series.
+func throttledResponse(series []pb.TimeSeries) *pb.WriteResponse {
+	resp := &pb.WriteResponse{RejectedByReason: map[string]uint64{}}
+	for i, ts := range series {
+		n := uint64(len(ts.Samples))
+		resp.Rejected += n
+		resp.RejectedByReason[reasonThrottled] += n
+		resp.PerSeries = append(resp.PerSeries, &pb.SeriesResult{
+			SeriesIndex:      int64(i),
+			Rejected:         n,
+			RejectedByReason: map[string]uint64{reasonThrottled: n},
+		})
+	}
+	remoteWriteAppendFailure.WithLabelValues(reasonThrottled).Add(float64(resp.Rejected))
+	return resp
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api_v2
+
+import (
+	"errors"
+	"testing"
+
+	pb "github.com/prometheus/prometheus/v3/prompb"
+	"github.com/prometheus/tsdb"
+)
+
+func TestRemoteWriteRejectReason(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"out of order", tsdb.ErrOutOfOrderSample, reasonOutOfOrder},
+		{"out of bounds", tsdb.ErrOutOfBounds, reasonOutOfBounds},
+		{"amend", tsdb.ErrAmendSample, reasonDuplicateSample},
+		{"unmapped error", errors.New("boom"), reasonOther},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := remoteWriteRejectReason(c.err); got != c.want {
+				t.Errorf("remoteWriteRejectReason(%v) = %q, want %q", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestThrottledResponse(t *testing.T) {
+	series := []pb.TimeSeries{
+		{Samples: []pb.Sample{{Value: 1}, {Value: 2}}},
+		{Samples: []pb.Sample{{Value: 3}}},
+	}
+
+	resp := throttledResponse(series)
+
+	if resp.Rejected != 3 {
+		t.Fatalf("Rejected = %d, want 3", resp.Rejected)
+	}
+	if resp.RejectedByReason[reasonThrottled] != 3 {
+		t.Fatalf("RejectedByReason[throttled] = %d, want 3", resp.RejectedByReason[reasonThrottled])
+	}
+	if len(resp.PerSeries) != 2 {
+		t.Fatalf("len(PerSeries) = %d, want 2 (one throttled entry per series)", len(resp.PerSeries))
+	}
+	for i, sr := range resp.PerSeries {
+		if sr.SeriesIndex != int64(i) {
+			t.Errorf("PerSeries[%d].SeriesIndex = %d, want %d", i, sr.SeriesIndex, i)
+		}
+		if sr.Rejected != uint64(len(series[i].Samples)) {
+			t.Errorf("PerSeries[%d].Rejected = %d, want %d", i, sr.Rejected, len(series[i].Samples))
+		}
+		if sr.RejectedByReason[reasonThrottled] != sr.Rejected {
+			t.Errorf("PerSeries[%d].RejectedByReason[throttled] = %d, want %d", i, sr.RejectedByReason[reasonThrottled], sr.Rejected)
+		}
+	}
+}
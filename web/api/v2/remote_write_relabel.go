@@ -0,0 +1,121 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api_v2
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/v3/pkg/labels"
+	"github.com/prometheus/prometheus/v3/pkg/relabel"
+	tsdbLabels "github.com/prometheus/tsdb/labels"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var remoteWriteDroppedSamples = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "prometheus_remote_write_dropped_samples_total",
+		Help: "Number of remote-write samples dropped by the ingest relabel pipeline, by reason.",
+	}, []string{"reason"},
+)
+
+func init() {
+	prometheus.MustRegister(remoteWriteDroppedSamples)
+}
+
+// relabelFileConfig is the top-level shape of the relabel pipeline config
+// file, mirroring the relabel_configs stanza of a scrape config.
+type relabelFileConfig struct {
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs"`
+}
+
+// loadRelabelRules parses the relabel pipeline config at path.
+func loadRelabelRules(path string) ([]*relabel.Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read relabel config")
+	}
+	var cfg relabelFileConfig
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, errors.Wrap(err, "parse relabel config")
+	}
+	return cfg.RelabelConfigs, nil
+}
+
+// watchRelabelConfig loads the relabel pipeline config at path, if any, and
+// installs a SIGHUP handler that reloads it for the lifetime of s.
+func (s *Admin) watchRelabelConfig(path string) {
+	if path == "" {
+		return
+	}
+	if err := s.reloadRelabelConfig(path); err != nil {
+		level.Error(s.logger).Log("msg", "failed to load remote-write relabel config", "path", path, "err", err)
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := s.reloadRelabelConfig(path); err != nil {
+				level.Error(s.logger).Log("msg", "failed to reload remote-write relabel config", "path", path, "err", err)
+				continue
+			}
+			level.Info(s.logger).Log("msg", "reloaded remote-write relabel config", "path", path)
+		}
+	}()
+}
+
+func (s *Admin) reloadRelabelConfig(path string) error {
+	rules, err := loadRelabelRules(path)
+	if err != nil {
+		return err
+	}
+	s.relabelRules.Store(rules)
+	return nil
+}
+
+// relabelLabels runs lbls through the configured relabel pipeline, if any.
+// It returns the rewritten labels and true to keep the series, or false if
+// the series was dropped. Callers are responsible for counting
+// remoteWriteDroppedSamples by the number of samples in the dropped series,
+// since this only sees its labels.
+func (s *Admin) relabelLabels(lbls tsdbLabels.Labels) (tsdbLabels.Labels, bool) {
+	rules, _ := s.relabelRules.Load().([]*relabel.Config)
+	if len(rules) == 0 {
+		return lbls, true
+	}
+
+	src := make(labels.Labels, len(lbls))
+	for i, l := range lbls {
+		src[i] = labels.Label{Name: l.Name, Value: l.Value}
+	}
+
+	out := relabel.Process(src, rules...)
+	if out == nil {
+		return nil, false
+	}
+
+	rewritten := make(tsdbLabels.Labels, len(out))
+	for i, l := range out {
+		rewritten[i] = tsdbLabels.Label{Name: l.Name, Value: l.Value}
+	}
+	sort.Sort(rewritten)
+	return rewritten, true
+}
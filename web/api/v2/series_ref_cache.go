@@ -0,0 +1,167 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api_v2
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	tsdbLabels "github.com/prometheus/tsdb/labels"
+)
+
+// defaultSeriesRefCacheSize bounds the number of series refs a seriesRefCache
+// keeps around. It is sized generously for high-cardinality remote-write
+// producers without letting a single misbehaving client grow it unbounded.
+const defaultSeriesRefCacheSize = 1 << 16
+
+var (
+	seriesRefCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_remote_write_series_ref_cache_hits_total",
+		Help: "Number of per-batch remote-write series lookups whose ref was served from cache.",
+	})
+	seriesRefCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_remote_write_series_ref_cache_misses_total",
+		Help: "Number of per-batch remote-write series lookups that found no cached entry for the series' hash.",
+	})
+	seriesRefCacheCollisions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_remote_write_series_ref_cache_collisions_total",
+		Help: "Number of times a cached series ref was discarded because its labels didn't match the hash's owner.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(seriesRefCacheHits, seriesRefCacheMisses, seriesRefCacheCollisions)
+}
+
+// refCacheEntry is the value stored for each cached series: the labels it
+// was cached under, alongside its TSDB ref. The labels are kept so a hash
+// collision between two distinct series can be detected on lookup instead
+// of silently handing out the wrong ref.
+type refCacheEntry struct {
+	hash uint64
+	lbls tsdbLabels.Labels
+	ref  uint64
+}
+
+// seriesRefCache is a bounded LRU mapping a series' label hash to the
+// labels and TSDB ref it was last appended under. TSDB head refs remain
+// valid across appenders (the scrape loop relies on exactly this to reuse
+// refs via AddFast from one scrape to the next), so a cached ref simply
+// falls back to Appender.Add on the rare ErrNotFound rather than being
+// evicted proactively on commit. The stored labels are compared on every
+// lookup so a 64-bit hash collision between two distinct series is caught
+// as a miss instead of handing out the wrong ref.
+//
+// It is shared across every batch of an Admin.RemoteWrite stream, and across
+// the gRPC and HTTP ingestion paths, so a client sending one sample per
+// series per message still gets the AddFast fast path after the first
+// message.
+type seriesRefCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[uint64]*list.Element
+	order    *list.List
+}
+
+func newSeriesRefCache(capacity int) *seriesRefCache {
+	return &seriesRefCache{
+		capacity: capacity,
+		entries:  make(map[uint64]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+// get returns the cached ref for lbls, if any. A hash match whose stored
+// labels don't equal lbls is a 64-bit hash collision between two distinct
+// series, not a cache hit; it is counted and reported as a miss so the
+// caller falls back to Appender.Add rather than appending lbls' samples
+// onto the wrong series.
+func (c *seriesRefCache) get(hash uint64, lbls tsdbLabels.Labels) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[hash]
+	if !ok {
+		seriesRefCacheMisses.Inc()
+		return 0, false
+	}
+	entry := el.Value.(*refCacheEntry)
+	if !labelsEqual(entry.lbls, lbls) {
+		seriesRefCacheCollisions.Inc()
+		return 0, false
+	}
+	c.order.MoveToFront(el)
+	seriesRefCacheHits.Inc()
+	return entry.ref, true
+}
+
+// put records ref as the current ref for lbls, evicting the least recently
+// used entry if the cache is at capacity. A put for a hash already owned
+// by different labels (a collision) replaces that entry outright: the
+// cache only ever trusts the most recently written owner of a hash, and
+// get confirms ownership before handing out a ref.
+func (c *seriesRefCache) put(hash uint64, lbls tsdbLabels.Labels, ref uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[hash]; ok {
+		entry := el.Value.(*refCacheEntry)
+		entry.lbls = lbls
+		entry.ref = ref
+		c.order.MoveToFront(el)
+		return
+	}
+
+	el := c.order.PushFront(&refCacheEntry{hash: hash, lbls: lbls, ref: ref})
+	c.entries[hash] = el
+
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*refCacheEntry).hash)
+	}
+}
+
+// labelsEqual reports whether a and b are the same series. Both sides are
+// always sorted by WriteTimeSeries before a hash is computed, so a simple
+// positional comparison is enough.
+func labelsEqual(a, b tsdbLabels.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+// forget discards the cached ref for hash, if any. It's used when a ref
+// turns out to be stale (Appender.ErrNotFound) so the next lookup for the
+// same series resolves cleanly via Add instead of hitting the same stale
+// entry again.
+func (c *seriesRefCache) forget(hash uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[hash]; ok {
+		c.order.Remove(el)
+		delete(c.entries, hash)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api_v2
+
+import (
+	"testing"
+
+	tsdbLabels "github.com/prometheus/tsdb/labels"
+)
+
+func TestSeriesRefCacheGetPut(t *testing.T) {
+	c := newSeriesRefCache(10)
+	lbls := tsdbLabels.Labels{{Name: "__name__", Value: "up"}}
+	hash := lbls.Hash()
+
+	if _, ok := c.get(hash, lbls); ok {
+		t.Fatalf("get on empty cache returned a hit")
+	}
+
+	c.put(hash, lbls, 42)
+	ref, ok := c.get(hash, lbls)
+	if !ok || ref != 42 {
+		t.Fatalf("get = (%d, %v), want (42, true)", ref, ok)
+	}
+
+	c.put(hash, lbls, 43)
+	if ref, ok := c.get(hash, lbls); !ok || ref != 43 {
+		t.Fatalf("get after overwrite = (%d, %v), want (43, true)", ref, ok)
+	}
+}
+
+// TestSeriesRefCacheHashCollision verifies that a hash match for a label
+// set that isn't actually the cached owner is reported as a miss instead
+// of handing out the owner's ref.
+func TestSeriesRefCacheHashCollision(t *testing.T) {
+	c := newSeriesRefCache(10)
+	owner := tsdbLabels.Labels{{Name: "__name__", Value: "up"}}
+	collider := tsdbLabels.Labels{{Name: "__name__", Value: "down"}}
+	const sharedHash = 12345
+
+	c.put(sharedHash, owner, 1)
+
+	if ref, ok := c.get(sharedHash, collider); ok {
+		t.Fatalf("get returned a hit for a colliding label set: ref=%d", ref)
+	}
+
+	// The owner's ref is unaffected by the failed lookup for collider.
+	if ref, ok := c.get(sharedHash, owner); !ok || ref != 1 {
+		t.Fatalf("get for owner = (%d, %v), want (1, true)", ref, ok)
+	}
+}
+
+func TestSeriesRefCacheForget(t *testing.T) {
+	c := newSeriesRefCache(10)
+	lbls := tsdbLabels.Labels{{Name: "__name__", Value: "up"}}
+	hash := lbls.Hash()
+
+	c.put(hash, lbls, 1)
+	c.forget(hash)
+
+	if _, ok := c.get(hash, lbls); ok {
+		t.Fatalf("get after forget returned a hit")
+	}
+
+	// Forgetting an absent hash is a no-op, not an error.
+	c.forget(hash)
+}
+
+func TestSeriesRefCacheEviction(t *testing.T) {
+	const capacity = 3
+	c := newSeriesRefCache(capacity)
+
+	var series []tsdbLabels.Labels
+	for i := 0; i < capacity+2; i++ {
+		lbls := tsdbLabels.Labels{{Name: "i", Value: string(rune('a' + i))}}
+		series = append(series, lbls)
+		c.put(lbls.Hash(), lbls, uint64(i))
+	}
+
+	for i, lbls := range series {
+		_, ok := c.get(lbls.Hash(), lbls)
+		if i < len(series)-capacity {
+			if ok {
+				t.Errorf("series %d should have been evicted but was still cached", i)
+			}
+		} else if !ok {
+			t.Errorf("series %d should still be cached but was evicted", i)
+		}
+	}
+}
+
+func TestLabelsEqual(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b tsdbLabels.Labels
+		want bool
+	}{
+		{"equal", tsdbLabels.Labels{{Name: "a", Value: "1"}}, tsdbLabels.Labels{{Name: "a", Value: "1"}}, true},
+		{"different value", tsdbLabels.Labels{{Name: "a", Value: "1"}}, tsdbLabels.Labels{{Name: "a", Value: "2"}}, false},
+		{"different name", tsdbLabels.Labels{{Name: "a", Value: "1"}}, tsdbLabels.Labels{{Name: "b", Value: "1"}}, false},
+		{"different length", tsdbLabels.Labels{{Name: "a", Value: "1"}}, tsdbLabels.Labels{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, false},
+		{"both empty", tsdbLabels.Labels{}, tsdbLabels.Labels{}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := labelsEqual(c.a, c.b); got != c.want {
+				t.Errorf("labelsEqual(%v, %v) = %v, want %v", c.a, c.b, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api_v2
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	snapshotUploadWorkers = 2
+	snapshotUploadRetries = 5
+)
+
+type snapshotState string
+
+const (
+	snapshotPending   snapshotState = "pending"
+	snapshotUploading snapshotState = "uploading"
+	snapshotDone      snapshotState = "done"
+	snapshotFailed    snapshotState = "failed"
+)
+
+var snapshotUploadBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "prometheus_tsdb_snapshot_upload_bytes_total",
+	Help: "Total bytes shipped from local TSDB snapshots to a configured backend.",
+})
+
+func init() {
+	prometheus.MustRegister(snapshotUploadBytesTotal)
+}
+
+// uploader ships a single file of a snapshot to a backend.
+type uploader interface {
+	// upload writes size bytes read from r to relPath under the
+	// uploader's destination.
+	upload(relPath string, r io.Reader, size int64) error
+}
+
+// snapshotJob tracks the async upload of one snapshot, as surfaced through
+// Admin.TSDBSnapshotStatus.
+type snapshotJob struct {
+	mu           sync.Mutex
+	id           string
+	dir          string
+	state        snapshotState
+	bytesShipped int64
+	err          string
+}
+
+func (j *snapshotJob) setState(s snapshotState) {
+	j.mu.Lock()
+	j.state = s
+	j.mu.Unlock()
+}
+
+func (j *snapshotJob) setErr(err error) {
+	j.mu.Lock()
+	j.state = snapshotFailed
+	j.err = err.Error()
+	j.mu.Unlock()
+}
+
+func (j *snapshotJob) addShipped(n int64) {
+	j.mu.Lock()
+	j.bytesShipped += n
+	j.mu.Unlock()
+}
+
+// status returns the current state, bytes shipped so far, and any error
+// message, for reporting back through TSDBSnapshotStatus.
+func (j *snapshotJob) status() (snapshotState, int64, string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state, j.bytesShipped, j.err
+}
+
+// snapshotManifestEntry is one uploaded file's entry in a snapshot's
+// manifest.json.
+type snapshotManifestEntry struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+// snapshotManifest is written alongside a snapshot's blocks once every file
+// has been shipped, so a restore tool can verify it got everything.
+type snapshotManifest struct {
+	SnapshotID string                  `json:"snapshot_id"`
+	Files      []snapshotManifestEntry `json:"files"`
+	TotalBytes int64                   `json:"total_bytes"`
+}
+
+// newUploader builds an uploader for a file:// or s3:// dest. A gs:// dest
+// is rejected with an error, as is any other scheme. credentialsRef, if set, is a path to credentials for the backend (e.g. an
+// AWS shared credentials file for s3://); the empty string uses the
+// backend's default credential chain.
+func newUploader(dest, credentialsRef string) (uploader, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse destination")
+	}
+	switch u.Scheme {
+	case "file":
+		return &fileUploader{baseDir: filepath.Join(u.Host, u.Path)}, nil
+	case "s3":
+		return newS3Uploader(u, credentialsRef)
+	case "gs":
+		// This build has no Cloud Storage client, so there is no gs
+		// uploader.
+		return nil, errors.New("gs destinations are not supported by this build; use s3:// or file://")
+	default:
+		return nil, errors.Errorf("unsupported snapshot destination scheme %q", u.Scheme)
+	}
+}
+
+// fileUploader copies snapshot files onto a local or mounted filesystem path.
+type fileUploader struct {
+	baseDir string
+}
+
+func (f *fileUploader) upload(relPath string, r io.Reader, size int64) error {
+	dst := filepath.Join(f.baseDir, relPath)
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, r)
+	return err
+}
+
+// s3Uploader ships snapshot files to an S3-compatible object store.
+type s3Uploader struct {
+	bucket, prefix string
+	uploader       *s3manager.Uploader
+}
+
+func newS3Uploader(dest *url.URL, credentialsRef string) (uploader, error) {
+	cfg := aws.NewConfig()
+	if credentialsRef != "" {
+		cfg = cfg.WithCredentials(credentials.NewSharedCredentials(credentialsRef, ""))
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "create s3 session")
+	}
+	return &s3Uploader{
+		bucket:   dest.Host,
+		prefix:   strings.TrimPrefix(dest.Path, "/"),
+		uploader: s3manager.NewUploader(sess),
+	}, nil
+}
+
+func (s *s3Uploader) upload(relPath string, r io.Reader, size int64) error {
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path.Join(s.prefix, relPath)),
+		Body:   r,
+	})
+	return err
+}
+
+// shipSnapshot walks job.dir and uploads every file to dest in the
+// background, retrying each file with exponential backoff, writes a
+// manifest.json listing everything it shipped, then optionally removes
+// job.dir. It is the async half of Admin.TSDBSnapshot.
+func (s *Admin) shipSnapshot(job *snapshotJob, dest, credentialsRef string, deleteLocal bool) {
+	s.snapshotUploadSem <- struct{}{}
+	defer func() { <-s.snapshotUploadSem }()
+
+	job.setState(snapshotUploading)
+
+	up, err := newUploader(dest, credentialsRef)
+	if err != nil {
+		job.setErr(err)
+		return
+	}
+
+	manifest := snapshotManifest{SnapshotID: job.id}
+
+	walkErr := filepath.Walk(job.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(job.dir, p)
+		if err != nil {
+			return err
+		}
+		if err := uploadWithRetry(up, rel, p, info.Size(), job); err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, snapshotManifestEntry{Path: rel, Bytes: info.Size()})
+		manifest.TotalBytes += info.Size()
+		return nil
+	})
+	if walkErr != nil {
+		job.setErr(walkErr)
+		return
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		job.setErr(errors.Wrap(err, "marshal manifest"))
+		return
+	}
+	if err := up.upload("manifest.json", bytes.NewReader(data), int64(len(data))); err != nil {
+		job.setErr(errors.Wrap(err, "upload manifest"))
+		return
+	}
+
+	job.setState(snapshotDone)
+	if deleteLocal {
+		if err := os.RemoveAll(job.dir); err != nil {
+			level.Error(s.logger).Log("msg", "failed to remove local snapshot after upload", "dir", job.dir, "err", err)
+		}
+	}
+}
+
+// uploadWithRetry uploads the block at path, reporting per-block progress
+// to job as each file completes.
+func uploadWithRetry(up uploader, relPath, path string, size int64, job *snapshotJob) error {
+	var lastErr error
+	backoff := 500 * time.Millisecond
+	for attempt := 0; attempt < snapshotUploadRetries; attempt++ {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		lastErr = up.upload(relPath, f, size)
+		f.Close()
+		if lastErr == nil {
+			snapshotUploadBytesTotal.Add(float64(size))
+			job.addShipped(size)
+			return nil
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return errors.Wrapf(lastErr, "upload %s after %d attempts", relPath, snapshotUploadRetries)
+}
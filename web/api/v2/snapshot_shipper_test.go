@@ -0,0 +1,126 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api_v2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// fakeUploader fails its first failUntil calls, then succeeds, recording
+// every relPath it was asked to upload.
+type fakeUploader struct {
+	failUntil int
+	calls     int
+	uploaded  []string
+}
+
+func (f *fakeUploader) upload(relPath string, r io.Reader, size int64) error {
+	f.calls++
+	if _, err := ioutil.ReadAll(r); err != nil {
+		return err
+	}
+	if f.calls <= f.failUntil {
+		return errors.New("transient upload failure")
+	}
+	f.uploaded = append(f.uploaded, relPath)
+	return nil
+}
+
+func TestUploadWithRetrySucceedsAfterTransientFailures(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "block")
+	if err := ioutil.WriteFile(src, []byte("data"), 0644); err != nil {
+		t.Fatalf("write fixture: %s", err)
+	}
+
+	up := &fakeUploader{failUntil: 2}
+	job := &snapshotJob{id: "snap", state: snapshotUploading}
+
+	if err := uploadWithRetry(up, "block", src, 4, job); err != nil {
+		t.Fatalf("uploadWithRetry() = %s, want success after transient failures", err)
+	}
+	if up.calls != 3 {
+		t.Errorf("upload called %d times, want 3 (2 failures + 1 success)", up.calls)
+	}
+	if _, shipped, _ := job.status(); shipped != 4 {
+		t.Errorf("job bytes shipped = %d, want 4", shipped)
+	}
+}
+
+func TestUploadWithRetryExhaustsAttempts(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "block")
+	if err := ioutil.WriteFile(src, []byte("data"), 0644); err != nil {
+		t.Fatalf("write fixture: %s", err)
+	}
+
+	up := &fakeUploader{failUntil: snapshotUploadRetries}
+	job := &snapshotJob{id: "snap", state: snapshotUploading}
+
+	err := uploadWithRetry(up, "block", src, 4, job)
+	if err == nil {
+		t.Fatal("uploadWithRetry() = nil, want an error after exhausting retries")
+	}
+	if up.calls != snapshotUploadRetries {
+		t.Errorf("upload called %d times, want %d", up.calls, snapshotUploadRetries)
+	}
+	if _, shipped, _ := job.status(); shipped != 0 {
+		t.Errorf("job bytes shipped = %d, want 0 on total failure", shipped)
+	}
+}
+
+func TestNewUploaderFile(t *testing.T) {
+	up, err := newUploader("file:///var/snapshots", "")
+	if err != nil {
+		t.Fatalf("newUploader(file://) = %s", err)
+	}
+	f, ok := up.(*fileUploader)
+	if !ok {
+		t.Fatalf("newUploader(file://) returned %T, want *fileUploader", up)
+	}
+	if want := "/var/snapshots"; f.baseDir != want {
+		t.Errorf("baseDir = %q, want %q", f.baseDir, want)
+	}
+}
+
+func TestNewUploaderUnsupportedScheme(t *testing.T) {
+	for _, dest := range []string{"gs://bucket/path", "ftp://bucket/path"} {
+		if _, err := newUploader(dest, ""); err == nil {
+			t.Errorf("newUploader(%q) = nil error, want an unsupported-scheme error", dest)
+		}
+	}
+}
+
+func TestFileUploaderUpload(t *testing.T) {
+	dir := t.TempDir()
+	f := &fileUploader{baseDir: dir}
+
+	content := []byte("snapshot bytes")
+	if err := f.upload("nested/block", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("upload() = %s", err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dir, "nested", "block"))
+	if err != nil {
+		t.Fatalf("read uploaded file: %s", err)
+	}
+	if string(got) != string(content) {
+		t.Errorf("uploaded content = %q, want %q", got, content)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api_v2
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/v3/pkg/timestamp"
+	pb "github.com/prometheus/prometheus/v3/prompb"
+	tsdbLabels "github.com/prometheus/tsdb/labels"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ValidationConfig bounds what DeleteSeries and RemoteWrite accept. It is
+// part of an Admin's construction so an operator can tune it for their
+// workload instead of being stuck with DefaultValidationConfig.
+type ValidationConfig struct {
+	// MaxLabelValueBytes is the byte cap on a single label value.
+	MaxLabelValueBytes int
+
+	// MaxPastDelta and MaxFutureDelta bound how far a sample's timestamp
+	// may drift from wall-clock time before it is rejected as bogus.
+	MaxPastDelta   time.Duration
+	MaxFutureDelta time.Duration
+}
+
+// DefaultValidationConfig is used by NewAdmin when no ValidationConfig is
+// given. MaxPastDelta is generous: remote-write clients legitimately
+// replay hours of buffered samples after a network outage, and a tight
+// bound here silently drops that backfill instead of rejecting it loudly.
+var DefaultValidationConfig = ValidationConfig{
+	MaxLabelValueBytes: 4096,
+	MaxPastDelta:       7 * 24 * time.Hour,
+	MaxFutureDelta:     10 * time.Minute,
+}
+
+// withDefaults returns c with any zero-valued field replaced by
+// DefaultValidationConfig's. Defaulting happens per field, not all-or-
+// nothing: a caller setting only MaxLabelValueBytes would otherwise be
+// left with a zero MaxPastDelta/MaxFutureDelta, which accepts only
+// ts == now and silently rejects essentially every sample as
+// out-of-bounds.
+func (c ValidationConfig) withDefaults() ValidationConfig {
+	if c.MaxLabelValueBytes == 0 {
+		c.MaxLabelValueBytes = DefaultValidationConfig.MaxLabelValueBytes
+	}
+	if c.MaxPastDelta == 0 {
+		c.MaxPastDelta = DefaultValidationConfig.MaxPastDelta
+	}
+	if c.MaxFutureDelta == 0 {
+		c.MaxFutureDelta = DefaultValidationConfig.MaxFutureDelta
+	}
+	return c
+}
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z_0-9]*$`)
+
+// validateLabel appends a *pb.ValidationError to errs for name if it isn't a
+// well-formed label name, or for value if it isn't valid, length-bounded
+// UTF-8. It returns the (possibly grown) errs slice.
+func (c ValidationConfig) validateLabel(name, value string, errs []*pb.ValidationError) []*pb.ValidationError {
+	if !labelNameRE.MatchString(name) {
+		return append(errs, &pb.ValidationError{Field: "label_name", Value: name, Message: "label name must match [a-zA-Z_][a-zA-Z_0-9]*"})
+	}
+	if !utf8.ValidString(value) {
+		return append(errs, &pb.ValidationError{Field: "label_value", Value: value, Message: "label value is not valid UTF-8"})
+	}
+	if len(value) > c.MaxLabelValueBytes {
+		return append(errs, &pb.ValidationError{Field: "label_value", Value: value, Message: fmt.Sprintf("label value exceeds %d bytes", c.MaxLabelValueBytes)})
+	}
+	return errs
+}
+
+// validateSeriesLabels reports whether every label of lbls is well-formed:
+// a name matching [a-zA-Z_][a-zA-Z_0-9]*, and a value that is valid UTF-8
+// within c.MaxLabelValueBytes.
+func (c ValidationConfig) validateSeriesLabels(lbls tsdbLabels.Labels) bool {
+	for _, l := range lbls {
+		if !labelNameRE.MatchString(l.Name) {
+			return false
+		}
+		if !utf8.ValidString(l.Value) || len(l.Value) > c.MaxLabelValueBytes {
+			return false
+		}
+	}
+	return true
+}
+
+// validateSampleTimestamp reports whether a sample timestamp (in millis) is
+// within [now-c.MaxPastDelta, now+c.MaxFutureDelta].
+func (c ValidationConfig) validateSampleTimestamp(ts int64) bool {
+	t := timestamp.Time(ts)
+	now := time.Now()
+	return !t.Before(now.Add(-c.MaxPastDelta)) && !t.After(now.Add(c.MaxFutureDelta))
+}
+
+// validationError builds a codes.InvalidArgument status carrying one
+// pb.ValidationError per offending label or matcher, so a bulk caller can
+// fix every problem in its request in a single round trip.
+func validationError(msg string, errs []*pb.ValidationError) error {
+	st := status.New(codes.InvalidArgument, msg)
+	details := make([]proto.Message, len(errs))
+	for i, e := range errs {
+		details[i] = e
+	}
+	stWithDetails, err := st.WithDetails(details...)
+	if err != nil {
+		// Attaching details failed (e.g. a mismatched generated type);
+		// fall back to the plain status rather than losing the error.
+		return st.Err()
+	}
+	return stWithDetails.Err()
+}
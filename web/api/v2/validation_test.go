@@ -0,0 +1,132 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api_v2
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/v3/pkg/timestamp"
+	pb "github.com/prometheus/prometheus/v3/prompb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidationConfigWithDefaults(t *testing.T) {
+	cases := []struct {
+		name string
+		in   ValidationConfig
+		want ValidationConfig
+	}{
+		{
+			name: "zero value takes every default",
+			in:   ValidationConfig{},
+			want: DefaultValidationConfig,
+		},
+		{
+			// Partial config must not zero out the rest: only
+			// MaxLabelValueBytes is set here, so MaxPastDelta and
+			// MaxFutureDelta should still come from the default
+			// instead of defaulting to zero durations.
+			name: "partial config only fills the zero fields",
+			in:   ValidationConfig{MaxLabelValueBytes: 8192},
+			want: ValidationConfig{
+				MaxLabelValueBytes: 8192,
+				MaxPastDelta:       DefaultValidationConfig.MaxPastDelta,
+				MaxFutureDelta:     DefaultValidationConfig.MaxFutureDelta,
+			},
+		},
+		{
+			name: "fully specified config is untouched",
+			in: ValidationConfig{
+				MaxLabelValueBytes: 1,
+				MaxPastDelta:       time.Minute,
+				MaxFutureDelta:     time.Second,
+			},
+			want: ValidationConfig{
+				MaxLabelValueBytes: 1,
+				MaxPastDelta:       time.Minute,
+				MaxFutureDelta:     time.Second,
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.in.withDefaults(); got != c.want {
+				t.Errorf("withDefaults() = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+// TestValidationConfigPartialDoesNotStarveTimestamps guards against the
+// all-or-nothing defaulting bug: a config that only tunes one field must
+// still accept present-day samples, not reject everything as out of
+// bounds.
+func TestValidationConfigPartialDoesNotStarveTimestamps(t *testing.T) {
+	c := ValidationConfig{MaxLabelValueBytes: 8192}.withDefaults()
+	now := timestamp.FromTime(time.Now())
+	if !c.validateSampleTimestamp(now) {
+		t.Fatalf("validateSampleTimestamp(now) = false after partial config, want true")
+	}
+}
+
+func TestValidateLabel(t *testing.T) {
+	c := DefaultValidationConfig
+
+	t.Run("valid", func(t *testing.T) {
+		errs := c.validateLabel("foo", "bar", nil)
+		if len(errs) != 0 {
+			t.Fatalf("validateLabel(valid) = %v, want no errors", errs)
+		}
+	})
+
+	t.Run("bad name", func(t *testing.T) {
+		errs := c.validateLabel("1bad", "bar", nil)
+		if len(errs) != 1 || errs[0].Value != "1bad" {
+			t.Fatalf("validateLabel(bad name) = %v, want one error with Value %q", errs, "1bad")
+		}
+	})
+
+	t.Run("invalid utf8 reports the value, not the name", func(t *testing.T) {
+		errs := c.validateLabel("foo", "bar\xff", nil)
+		if len(errs) != 1 || errs[0].Value != "bar\xff" {
+			t.Fatalf("validateLabel(bad utf8) = %v, want one error with Value %q", errs, "bar\xff")
+		}
+	})
+
+	t.Run("oversize value reports the value, not the name", func(t *testing.T) {
+		big := make([]byte, c.MaxLabelValueBytes+1)
+		errs := c.validateLabel("foo", string(big), nil)
+		if len(errs) != 1 || errs[0].Value != string(big) {
+			t.Fatalf("validateLabel(oversize) Value = %q, want the oversize value", errs[0].Value)
+		}
+	})
+}
+
+func TestValidationErrorAttachesDetails(t *testing.T) {
+	err := validationError("invalid matchers", []*pb.ValidationError{
+		{Field: "label_name", Value: "1bad", Message: "bad name"},
+	})
+	if err == nil {
+		t.Fatal("validationError returned nil")
+	}
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.InvalidArgument {
+		t.Fatalf("validationError code = %v, want %v", st.Code(), codes.InvalidArgument)
+	}
+	if n := len(st.Proto().GetDetails()); n != 1 {
+		t.Fatalf("validationError carries %d details, want 1", n)
+	}
+}